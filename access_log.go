@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogFormat selects the output format used by NewAccessLogHandler.
+type LogFormat int
+
+const (
+	// CommonLogFormat emits lines in the Apache Common Log Format.
+	CommonLogFormat LogFormat = iota
+	// CombinedLogFormat emits lines in the Apache Combined Log Format,
+	// which adds the Referer and User-Agent headers to CommonLogFormat.
+	CombinedLogFormat
+	// JSONLogFormat emits one JSON object per request.
+	JSONLogFormat
+)
+
+// LogOptions configures NewAccessLogHandler.
+type LogOptions struct {
+	// Writer is where log lines are written. Defaults to os.Stderr.
+	Writer io.Writer
+	// Format selects the log line format. Defaults to CommonLogFormat.
+	Format LogFormat
+}
+
+// accessLogEntry holds everything logged for a single proxied request.
+type accessLogEntry struct {
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"-"`
+	Upstream  string    `json:"upstream"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMs float64   `json:"latency_ms"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Time      time.Time `json:"time"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// loggingResponseWriter wraps an http.ResponseWriter to capture the status
+// code and the number of bytes written, the way gorilla/handlers'
+// LoggingHandler does. Only the first WriteHeader call is recorded, since a
+// handler calling it again is sending a superfluous (and ignored) header.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+	upstream    string
+}
+
+// upstreamReporter lets a Forwarder record which backend actually served a
+// request. loggingResponseWriter implements this, and CUIForwarder calls it
+// with the backend it picked from its UpstreamPool, so the access log doesn't
+// have to fall back to guessing the pre-pool static upstream URL.
+type upstreamReporter interface {
+	reportUpstream(url string)
+}
+
+func (w *loggingResponseWriter) reportUpstream(url string) {
+	w.upstream = url
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets a wrapped handler take over the connection, the way
+// serveWebSocket and serveConnect do. Without this, wrapping a Forwarder in
+// NewAccessLogHandler would break their w.(http.Hijacker) type assertion.
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+// NewAccessLogHandler wraps f with a logging middleware analogous to
+// gorilla/handlers' LoggingHandler/CombinedLoggingHandler: it records the
+// upstream status code, response size and latency for every request and
+// writes one log line per request to opts.Writer in opts.Format.
+func NewAccessLogHandler(f Forwarder, opts LogOptions) http.HandlerFunc {
+	if opts.Writer == nil {
+		opts.Writer = os.Stderr
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+
+		f.ForwardRequest(lw, r)
+
+		upstream := lw.upstream
+		if upstream == "" {
+			upstream = service1BaseURL + r.URL.Path
+		}
+
+		writeAccessLogEntry(opts.Writer, opts.Format, accessLogEntry{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Proto:     r.Proto,
+			Upstream:  upstream,
+			Status:    lw.status,
+			Bytes:     lw.bytes,
+			LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+			RequestID: requestID,
+			ClientIP:  clientIPFromRequest(r),
+			Time:      start,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	}
+}
+
+// clientIPFromRequest derives the originating client IP, preferring the
+// first hop of X-Forwarded-For and falling back to the connection's remote
+// address.
+func clientIPFromRequest(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func writeAccessLogEntry(w io.Writer, format LogFormat, e accessLogEntry) {
+	switch format {
+	case JSONLogFormat:
+		json.NewEncoder(w).Encode(e)
+	case CombinedLogFormat:
+		fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d %q %q\n",
+			e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method, e.Path, e.Proto, e.Status, e.Bytes, e.Referer, e.UserAgent)
+	default:
+		fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d\n",
+			e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method, e.Path, e.Proto, e.Status, e.Bytes)
+	}
+}
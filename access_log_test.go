@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogHandler_RecordsStatusDespiteMultipleWriteHeaderCalls(t *testing.T) {
+	mock := &MockForwarder{
+		ForwardRequestFunc: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusOK) // superfluous; must not win
+			w.Write([]byte("boom"))
+		},
+	}
+
+	var buf bytes.Buffer
+	handler := NewAccessLogHandler(mock, LogOptions{Writer: &buf, Format: JSONLogFormat})
+
+	req := httptest.NewRequest("GET", "/error", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log line: %v", err)
+	}
+	if entry.Status != http.StatusInternalServerError {
+		t.Errorf("expected logged status %d, got %d", http.StatusInternalServerError, entry.Status)
+	}
+	if entry.Bytes != len("boom") {
+		t.Errorf("expected logged bytes %d, got %d", len("boom"), entry.Bytes)
+	}
+}
+
+func TestAccessLogHandler_RecordsBytesStreamedViaIOCopy(t *testing.T) {
+	payload := strings.Repeat("x", 4096)
+	mock := &MockForwarder{
+		ForwardRequestFunc: func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, strings.NewReader(payload))
+		},
+	}
+
+	var buf bytes.Buffer
+	handler := NewAccessLogHandler(mock, LogOptions{Writer: &buf, Format: JSONLogFormat})
+
+	req := httptest.NewRequest("GET", "/stream", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log line: %v", err)
+	}
+	if entry.Status != http.StatusOK {
+		t.Errorf("expected default status 200 for implicit WriteHeader, got %d", entry.Status)
+	}
+	if entry.Bytes != len(payload) {
+		t.Errorf("expected logged bytes %d, got %d", len(payload), entry.Bytes)
+	}
+}
+
+func TestAccessLogHandler_JSONFields(t *testing.T) {
+	mock := &MockForwarder{
+		ForwardRequestFunc: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		},
+	}
+
+	var buf bytes.Buffer
+	handler := NewAccessLogHandler(mock, LogOptions{Writer: &buf, Format: JSONLogFormat})
+
+	req := httptest.NewRequest("POST", "/api/data", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+	req.Header.Set("X-Request-Id", "req-123")
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log line: %v", err)
+	}
+	if entry.Method != "POST" || entry.Path != "/api/data" {
+		t.Errorf("unexpected method/path: %s %s", entry.Method, entry.Path)
+	}
+	if entry.ClientIP != "203.0.113.5" {
+		t.Errorf("expected client IP derived from X-Forwarded-For, got %q", entry.ClientIP)
+	}
+	if entry.RequestID != "req-123" {
+		t.Errorf("expected request ID to be taken from X-Request-Id, got %q", entry.RequestID)
+	}
+	if entry.Upstream != service1BaseURL+"/api/data" {
+		t.Errorf("unexpected upstream URL: %q", entry.Upstream)
+	}
+}
+
+func TestAccessLogHandler_RecordsActualPooledBackend(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(upstream.URL)},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{})
+
+	var buf bytes.Buffer
+	handler := NewAccessLogHandler(f, LogOptions{Writer: &buf, Format: JSONLogFormat})
+
+	req := httptest.NewRequest("GET", "/widgets", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log line: %v", err)
+	}
+	if want := upstream.URL + "/widgets"; entry.Upstream != want {
+		t.Errorf("expected the actual pooled backend to be logged, got %q want %q", entry.Upstream, want)
+	}
+}
+
+func TestAccessLogHandler_CommonLogFormat(t *testing.T) {
+	mock := &MockForwarder{
+		ForwardRequestFunc: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("hi"))
+		},
+	}
+
+	var buf bytes.Buffer
+	handler := NewAccessLogHandler(mock, LogOptions{Writer: &buf, Format: CommonLogFormat})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	line := buf.String()
+	if !strings.Contains(line, `"GET / HTTP/1.1"`) {
+		t.Errorf("expected common log request line, got %q", line)
+	}
+	if !strings.Contains(line, " 200 2") {
+		t.Errorf("expected status 200 and 2 bytes in log line, got %q", line)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies this package as the source of its traces
+// and metrics.
+const instrumentationName = "github.com/AishwaryakMohan/proxy-check"
+
+// Option configures optional CUIForwarder behaviour, such as OpenTelemetry
+// instrumentation, and is passed to NewCUIForwarder.
+type Option func(*CUIForwarder)
+
+// WithTracerProvider sets the trace.TracerProvider used to start a span for
+// each forwarded request. Defaults to the globally configured provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(f *CUIForwarder) { f.tracerProvider = tp }
+}
+
+// WithMeterProvider sets the metric.MeterProvider used to record request
+// counts, in-flight requests, and upstream latency. Defaults to the
+// globally configured provider.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(f *CUIForwarder) { f.meterProvider = mp }
+}
+
+// instruments holds the metric instruments lazily created from a
+// CUIForwarder's MeterProvider.
+type instruments struct {
+	requests        metric.Int64Counter
+	inFlight        metric.Int64UpDownCounter
+	upstreamLatency metric.Float64Histogram
+}
+
+// tracer returns f's configured tracer, falling back to the globally
+// registered TracerProvider when none was set via WithTracerProvider.
+func (f *CUIForwarder) tracer() trace.Tracer {
+	tp := f.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+// instruments lazily creates f's metric instruments from its configured
+// MeterProvider, falling back to the globally registered one.
+func (f *CUIForwarder) instruments() *instruments {
+	f.instrumentsOnce.Do(func() {
+		mp := f.meterProvider
+		if mp == nil {
+			mp = otel.GetMeterProvider()
+		}
+		meter := mp.Meter(instrumentationName)
+
+		requests, _ := meter.Int64Counter("forward.requests",
+			metric.WithDescription("Number of requests forwarded upstream"))
+		inFlight, _ := meter.Int64UpDownCounter("forward.in_flight",
+			metric.WithDescription("Number of requests currently being forwarded"))
+		upstreamLatency, _ := meter.Float64Histogram("forward.upstream.latency_ms",
+			metric.WithDescription("Latency of the upstream request in milliseconds"))
+
+		f.cachedInstruments = &instruments{
+			requests:        requests,
+			inFlight:        inFlight,
+			upstreamLatency: upstreamLatency,
+		}
+	})
+	return f.cachedInstruments
+}
+
+// spanName follows the "forward <method> <path>" convention for proxied
+// requests.
+func spanName(method, path string) string {
+	return fmt.Sprintf("forward %s %s", method, path)
+}
+
+// recordUpstreamOutcome records the span attributes/status and the request
+// count and latency metrics for one upstream attempt: its target host,
+// status code (or error), and latency.
+func recordUpstreamOutcome(ctx context.Context, span trace.Span, inst *instruments, host string, status int, err error, latency time.Duration) {
+	attrs := []attribute.KeyValue{attribute.String("net.peer.name", host)}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		attrs = append(attrs, attribute.Int("http.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("upstream returned %d", status))
+		}
+	}
+	span.SetAttributes(attrs...)
+
+	if inst == nil {
+		return
+	}
+	inst.requests.Add(ctx, 1, metric.WithAttributes(attrs...))
+	inst.upstreamLatency.Record(ctx, float64(latency.Milliseconds()), metric.WithAttributes(attrs...))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestCUIForwarder_EmitsSpanWithExpectedAttributes(t *testing.T) {
+	prior := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(prior)
+
+	var gotTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTraceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(upstream.URL)},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{}, WithTracerProvider(tp))
+
+	req := httptest.NewRequest("GET", "/widgets", nil)
+	w := httptest.NewRecorder()
+	f.ForwardRequest(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if gotTraceparent == "" {
+		t.Error("expected trace context to propagate to the upstream request via Traceparent header")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected exactly one span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "forward GET /widgets" {
+		t.Errorf("expected span name %q, got %q", "forward GET /widgets", span.Name)
+	}
+
+	attrs := map[string]bool{}
+	var gotStatus int64
+	for _, a := range span.Attributes {
+		if a.Key == "http.status_code" {
+			gotStatus = a.Value.AsInt64()
+		}
+		attrs[string(a.Key)] = true
+	}
+	if gotStatus != http.StatusOK {
+		t.Errorf("expected http.status_code attribute 200, got %d", gotStatus)
+	}
+	if !attrs["net.peer.name"] {
+		t.Error("expected net.peer.name attribute on the span")
+	}
+}
+
+func TestCUIForwarder_MarksSpanErrorOn5xx(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(upstream.URL)},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{}, WithTracerProvider(tp))
+
+	req := httptest.NewRequest("GET", "/broken", nil)
+	w := httptest.NewRecorder()
+	f.ForwardRequest(w, req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected exactly one span, got %d", len(spans))
+	}
+	if spans[0].Status.Code.String() != "Error" {
+		t.Errorf("expected span status Error for a 5xx upstream response, got %v", spans[0].Status.Code)
+	}
+}
+
+func TestCUIForwarder_RecordsMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(upstream.URL)},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{}, WithMeterProvider(mp))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	f.ForwardRequest(w, req)
+
+	var data metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &data); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+
+	found := map[string]bool{}
+	for _, sm := range data.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			found[m.Name] = true
+		}
+	}
+	for _, name := range []string{"forward.requests", "forward.in_flight", "forward.upstream.latency_ms"} {
+		if !found[name] {
+			t.Errorf("expected metric %q to be recorded, got %v", name, found)
+		}
+	}
+}
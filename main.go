@@ -2,13 +2,116 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const service1BaseURL = "http://localhost:8081"
 
+// maxBufferedRetryBody bounds how much of a request body ForwardRequest will
+// buffer in memory to replay against a different backend on retry.
+const maxBufferedRetryBody = 10 << 20 // 10 MiB
+
+// ForwarderConfig holds the tunable behaviour of CUIForwarder.
+type ForwarderConfig struct {
+	// AuthAddress, when set, enables Traefik-style ForwardAuth: before a
+	// request is proxied upstream, a GET is issued to this address and the
+	// proxy either continues or short-circuits based on its response.
+	AuthAddress string
+
+	// TrustForwardHeader controls whether X-Forwarded-* headers already
+	// present on the incoming request are copied onto the auth request,
+	// rather than being left off it. X-Forwarded-For is then appended to
+	// with the client IP; X-Forwarded-Method, -Host, -Uri and -Proto are
+	// always set from the incoming request itself.
+	TrustForwardHeader bool
+
+	// AuthRequestHeaders is the whitelist of headers copied from the
+	// incoming request onto the auth request, in addition to the
+	// X-Forwarded-* headers that ForwardAuth always sends.
+	AuthRequestHeaders []string
+
+	// AuthResponseHeaders is the whitelist of headers copied from a
+	// successful auth response onto the upstream request.
+	AuthResponseHeaders []string
+
+	// XForwardedHeaders controls how the proxy's own X-Forwarded-For,
+	// X-Forwarded-Proto and X-Forwarded-Host headers are populated,
+	// following the gorilla/handlers ProxyHeaders convention: when false
+	// (the default), any values the client sent for these headers are
+	// discarded and replaced; when true, existing values are trusted,
+	// with X-Forwarded-For appended to rather than overwritten.
+	XForwardedHeaders bool
+
+	// MaxRetries is how many additional backends an idempotent request may
+	// be retried against after a network error or a retriable status code.
+	// Zero (the default) disables retries.
+	MaxRetries int
+
+	// RetriableStatuses is the set of upstream status codes that trigger a
+	// retry against the next healthy backend. Defaults to 502, 503 and 504
+	// when empty.
+	RetriableStatuses []int
+
+	// AllowedConnectHosts restricts which destinations a CONNECT request may
+	// tunnel to. Each entry is either a full "host:port", allowing exactly
+	// that destination, or a bare host, allowing any port on it. CONNECT is
+	// refused with 403 Forbidden when the target isn't listed. It's refused
+	// entirely when AllowedConnectHosts is empty (the default): ForwardAuth
+	// is opt-in, so forwarding a client-supplied destination with no
+	// allowlist at all would make this proxy an open TCP relay.
+	AllowedConnectHosts []string
+}
+
+// hopByHopHeaders are connection-specific headers that must not be forwarded
+// between a client and an upstream server, per RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authorization",
+	"TE",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// sanitizeHeaders strips hop-by-hop headers from h, including any header
+// named in h's own Connection value, so they aren't leaked between the
+// client and the upstream server in either direction.
+func sanitizeHeaders(h http.Header) {
+	sanitizeHeadersExcept(h, nil)
+}
+
+// sanitizeHeadersExcept behaves like sanitizeHeaders but leaves any header
+// named in keep untouched. It is used for WebSocket upgrades, where
+// Connection and Upgrade must reach the upstream server intact.
+func sanitizeHeadersExcept(h http.Header, keep map[string]bool) {
+	for _, token := range strings.Split(h.Get("Connection"), ",") {
+		if token = strings.TrimSpace(token); token != "" && !keep[http.CanonicalHeaderKey(token)] {
+			h.Del(token)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		if keep[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		h.Del(name)
+	}
+}
+
 type Forwarder interface {
 	ForwardRequest(w http.ResponseWriter, r *http.Request)
 }
@@ -20,40 +123,385 @@ func CUIForwarderHandler(f Forwarder) http.HandlerFunc {
 }
 
 func main() {
-	c := CUIForwarder{}
-	http.HandleFunc("/", CUIForwarderHandler(&c))
-	log.Println("Service 2 running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	listenAddr := flag.String("listen", ":8080", "address to listen on")
+	backends := flag.String("backends", service1BaseURL, "comma-separated backend URLs to load-balance across")
+	authAddress := flag.String("auth-address", "", "ForwardAuth address; requests are authorized against it before proxying when set")
+	maxRetries := flag.Int("max-retries", 0, "number of additional backends an idempotent request may be retried against")
+	healthPath := flag.String("health-path", "", "path probed on each backend for active health checks; disabled when empty")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "interval between active health checks")
+	logFormat := flag.String("log-format", "common", "access log format: common, combined or json")
+	allowedConnectHosts := flag.String("allowed-connect-hosts", "", "comma-separated host[:port] destinations CONNECT tunnels may reach; CONNECT is refused entirely when empty")
+	flag.Parse()
+
+	var connectHosts []string
+	if *allowedConnectHosts != "" {
+		connectHosts = strings.Split(*allowedConnectHosts, ",")
+	}
+
+	pool := NewUpstreamPool(strings.Split(*backends, ","), RoundRobin, HealthCheckConfig{
+		Path:     *healthPath,
+		Interval: *healthInterval,
+	})
+	defer pool.Close()
+
+	f := NewCUIForwarder(pool, ForwarderConfig{
+		AuthAddress:         *authAddress,
+		MaxRetries:          *maxRetries,
+		AllowedConnectHosts: connectHosts,
+	}, WithTracerProvider(otel.GetTracerProvider()), WithMeterProvider(otel.GetMeterProvider()))
+
+	format := CommonLogFormat
+	switch *logFormat {
+	case "combined":
+		format = CombinedLogFormat
+	case "json":
+		format = JSONLogFormat
+	}
+
+	http.HandleFunc("/", NewAccessLogHandler(f, LogOptions{Format: format}))
+	log.Printf("Service 2 running on http://localhost%s, forwarding to %v", *listenAddr, strings.Split(*backends, ","))
+	log.Fatal(http.ListenAndServe(*listenAddr, nil))
 }
 
 type CUIForwarder struct {
-	c *http.Client
+	c      *http.Client
+	Config ForwarderConfig
+
+	// upstreamPool is the set of backends to load-balance across. When nil,
+	// ForwardRequest falls back to the single service1BaseURL backend for
+	// backwards compatibility with the zero-value CUIForwarder.
+	upstreamPool *UpstreamPool
+
+	tracerProvider    trace.TracerProvider
+	meterProvider     metric.MeterProvider
+	instrumentsOnce   sync.Once
+	cachedInstruments *instruments
 }
 
-func (f *CUIForwarder) ForwardRequest(w http.ResponseWriter, r *http.Request) {
-	targetURL := service1BaseURL + r.URL.Path
+// NewCUIForwarder constructs a CUIForwarder that load-balances requests
+// across pool according to cfg. Requests are always instrumented with
+// OpenTelemetry; use WithTracerProvider/WithMeterProvider to choose the
+// providers, which otherwise default to the globally registered ones.
+func NewCUIForwarder(pool *UpstreamPool, cfg ForwarderConfig, opts ...Option) *CUIForwarder {
+	f := &CUIForwarder{upstreamPool: pool, Config: cfg}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
 
-	req, err := http.NewRequest(r.Method, targetURL+"?"+r.URL.RawQuery, r.Body)
+// forwardAuth performs the ForwardAuth check for r against f.Config.AuthAddress.
+// It returns true if the caller should proceed with proxying the request
+// upstream, having already copied any AuthResponseHeaders onto req. It
+// returns false if the auth server rejected the request, in which case its
+// response has already been written to w.
+func (f *CUIForwarder) forwardAuth(w http.ResponseWriter, r *http.Request, req *http.Request) bool {
+	if f.Config.AuthAddress == "" {
+		return true
+	}
+
+	authReq, err := http.NewRequest(http.MethodGet, f.Config.AuthAddress, nil)
 	if err != nil {
-		http.Error(w, "Failed to create request: "+err.Error(), http.StatusInternalServerError)
-		return
+		http.Error(w, "Failed to create auth request: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if f.Config.TrustForwardHeader {
+		for k, vv := range r.Header {
+			if isXForwardedHeader(k) {
+				for _, v := range vv {
+					authReq.Header.Add(k, v)
+				}
+			}
+		}
+	}
+
+	// Always send a real X-Forwarded-For, the same way setForwardedHeaders
+	// does for the upstream request: an auth server can't do IP-based
+	// allow/deny without it, and TrustForwardHeader shouldn't mean "never
+	// tell the auth server who the client is".
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	if prior := authReq.Header.Get("X-Forwarded-For"); f.Config.TrustForwardHeader && prior != "" {
+		authReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		authReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	authReq.Header.Set("X-Forwarded-Method", r.Method)
+	authReq.Header.Set("X-Forwarded-Host", r.Host)
+	authReq.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if r.TLS != nil {
+		authReq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		authReq.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	for _, h := range f.Config.AuthRequestHeaders {
+		if v := r.Header.Values(h); len(v) > 0 {
+			authReq.Header[h] = append([]string(nil), v...)
+		}
 	}
-	req.Header = r.Header.Clone()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	client := f.authClient()
+	authResp, err := client.Do(authReq)
 	if err != nil {
-		http.Error(w, "Request failed: "+err.Error(), http.StatusBadGateway)
+		http.Error(w, "Auth request failed: "+err.Error(), http.StatusBadGateway)
+		return false
+	}
+	defer authResp.Body.Close()
+
+	if authResp.StatusCode < 200 || authResp.StatusCode >= 300 {
+		for k, vv := range authResp.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(authResp.StatusCode)
+		io.Copy(w, authResp.Body)
+		return false
+	}
+
+	for _, h := range f.Config.AuthResponseHeaders {
+		if v := authResp.Header.Values(h); len(v) > 0 {
+			req.Header[h] = append([]string(nil), v...)
+		}
+	}
+
+	return true
+}
+
+func isXForwardedHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Method", "X-Forwarded-Uri", "X-Real-Ip":
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *CUIForwarder) client() *http.Client {
+	if f.c != nil {
+		return f.c
+	}
+	return &http.Client{}
+}
+
+// authClient returns the HTTP client used for ForwardAuth requests. Redirects
+// from the auth server are not followed; they are forwarded to the client
+// as-is so it can act on them (e.g. for an SSO login redirect).
+func (f *CUIForwarder) authClient() *http.Client {
+	c := *f.client()
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &c
+}
+
+// setForwardedHeaders populates h's X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and X-Real-Ip entries from the original client request
+// r, honouring f.Config.XForwardedHeaders.
+func (f *CUIForwarder) setForwardedHeaders(h http.Header, r *http.Request) {
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	if prior := h.Get("X-Forwarded-For"); f.Config.XForwardedHeaders && prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		h.Set("X-Forwarded-For", clientIP)
+	}
+
+	if !(f.Config.XForwardedHeaders && h.Get("X-Forwarded-Proto") != "") {
+		if r.TLS != nil {
+			h.Set("X-Forwarded-Proto", "https")
+		} else {
+			h.Set("X-Forwarded-Proto", "http")
+		}
+	}
+
+	if !(f.Config.XForwardedHeaders && h.Get("X-Forwarded-Host") != "") {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+
+	h.Set("X-Real-Ip", clientIP)
+}
+
+// pickBackend selects the next backend to try, skipping those in exclude.
+// With no upstreamPool configured, it always returns the legacy static
+// service1BaseURL backend.
+func (f *CUIForwarder) pickBackend(exclude map[*backend]bool) (*backend, error) {
+	if f.upstreamPool == nil {
+		return &backend{url: service1BaseURL, healthy: true}, nil
+	}
+	return f.upstreamPool.Next(exclude)
+}
+
+func (f *CUIForwarder) recordResult(b *backend, success bool) {
+	if f.upstreamPool == nil {
+		return
+	}
+	if success {
+		f.upstreamPool.markSuccess(b)
+	} else {
+		f.upstreamPool.markFailure(b)
+	}
+}
+
+var defaultRetriableStatuses = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+func (f *CUIForwarder) isRetriableStatus(status int) bool {
+	if len(f.Config.RetriableStatuses) == 0 {
+		return defaultRetriableStatuses[status]
+	}
+	for _, s := range f.Config.RetriableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// statusOrZero returns resp's status code, or 0 if resp is nil (i.e. the
+// request failed before a response was received).
+func statusOrZero(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *CUIForwarder) ForwardRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		f.serveConnect(w, r)
+		return
+	}
+	if isWebSocketUpgrade(r) {
+		f.serveWebSocket(w, r)
+		return
+	}
+
+	attempts := 1
+	if isIdempotentMethod(r.Method) && f.Config.MaxRetries > 0 {
+		attempts = f.Config.MaxRetries + 1
+	}
+
+	// Only buffer the body when a retry could actually replay it against a
+	// different backend; otherwise stream r.Body straight through to the
+	// upstream request, so a large upload isn't forced into memory for a
+	// request that's only ever sent once. bufferedBody is capped so a
+	// client can't use the retry path itself to exhaust memory.
+	var bufferedBody []byte
+	if attempts > 1 {
+		var err error
+		bufferedBody, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxBufferedRetryBody))
+		if err != nil {
+			http.Error(w, "Failed to read request body: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ctx, span := f.tracer().Start(r.Context(), spanName(r.Method, r.URL.Path))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	inst := f.instruments()
+	inst.inFlight.Add(ctx, 1)
+	defer inst.inFlight.Add(ctx, -1)
+
+	headers := r.Header.Clone()
+	sanitizeHeaders(headers)
+	f.setForwardedHeaders(headers, r)
+
+	authedHeaders := &http.Request{Header: headers}
+	if !f.forwardAuth(w, r, authedHeaders) {
 		return
 	}
-	defer resp.Body.Close()
 
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			w.Header().Add(k, v)
+	excluded := map[*backend]bool{}
+	var lastErr error
+	client := f.client()
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		b, err := f.pickBackend(excluded)
+		if err != nil {
+			lastErr = err
+			break
 		}
+		if reporter, ok := w.(upstreamReporter); ok {
+			reporter.reportUpstream(b.url + r.URL.Path)
+		}
+
+		var reqBody io.Reader = r.Body
+		if attempts > 1 {
+			reqBody = bytes.NewReader(bufferedBody)
+		}
+		req, err := http.NewRequest(r.Method, b.url+r.URL.Path+"?"+r.URL.RawQuery, reqBody)
+		if err != nil {
+			http.Error(w, "Failed to create request: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Header = headers.Clone()
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		atomic.AddInt64(&b.activeConns, 1)
+		attemptStart := time.Now()
+		resp, err := client.Do(req)
+		atomic.AddInt64(&b.activeConns, -1)
+		recordUpstreamOutcome(ctx, span, inst, req.URL.Hostname(), statusOrZero(resp), err, time.Since(attemptStart))
+		if err != nil {
+			lastErr = err
+			excluded[b] = true
+			f.recordResult(b, false)
+			continue
+		}
+
+		if f.isRetriableStatus(resp.StatusCode) && attempt < attempts-1 {
+			resp.Body.Close()
+			excluded[b] = true
+			f.recordResult(b, false)
+			continue
+		}
+
+		f.recordResult(b, true)
+		defer resp.Body.Close()
+
+		streaming := isStreamingResponse(resp)
+		sanitizeHeaders(resp.Header)
+		for k, vv := range resp.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+
+		if streaming {
+			streamResponseBody(w, resp.Body)
+		} else {
+			io.Copy(w, resp.Body)
+		}
+		return
 	}
-	w.WriteHeader(resp.StatusCode)
 
-	io.Copy(w, resp.Body)
+	if lastErr != nil {
+		http.Error(w, "Request failed: "+lastErr.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Error(w, "No healthy upstream backend available", http.StatusBadGateway)
 }
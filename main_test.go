@@ -1,12 +1,178 @@
 package main
 
 import (
+	"crypto/tls"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 )
 
+func TestForwardAuth_Success(t *testing.T) {
+	var gotMethod, gotHost, gotURI string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Header.Get("X-Forwarded-Method")
+		gotHost = r.Header.Get("X-Forwarded-Host")
+		gotURI = r.Header.Get("X-Forwarded-Uri")
+		w.Header().Set("X-Auth-User", "alice")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authServer.Close()
+
+	f := &CUIForwarder{
+		Config: ForwarderConfig{
+			AuthAddress:         authServer.URL,
+			AuthResponseHeaders: []string{"X-Auth-User"},
+		},
+	}
+
+	r := httptest.NewRequest("GET", "/secret?a=b", nil)
+	r.Host = "example.com"
+	req, _ := http.NewRequest(r.Method, "http://upstream.example/secret", nil)
+	req.Header = r.Header.Clone()
+
+	w := httptest.NewRecorder()
+	ok := f.forwardAuth(w, r, req)
+	if !ok {
+		t.Fatalf("expected forwardAuth to allow the request, got response %d", w.Code)
+	}
+	if gotMethod != "GET" {
+		t.Errorf("expected X-Forwarded-Method GET, got %q", gotMethod)
+	}
+	if gotHost != "example.com" {
+		t.Errorf("expected X-Forwarded-Host example.com, got %q", gotHost)
+	}
+	if gotURI != "/secret?a=b" {
+		t.Errorf("expected X-Forwarded-Uri /secret?a=b, got %q", gotURI)
+	}
+	if req.Header.Get("X-Auth-User") != "alice" {
+		t.Errorf("expected X-Auth-User to be copied onto upstream request, got %q", req.Header.Get("X-Auth-User"))
+	}
+}
+
+func TestForwardAuth_Failure(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+	}))
+	defer authServer.Close()
+
+	f := &CUIForwarder{
+		Config: ForwarderConfig{AuthAddress: authServer.URL},
+	}
+
+	r := httptest.NewRequest("GET", "/secret", nil)
+	req, _ := http.NewRequest(r.Method, "http://upstream.example/secret", nil)
+
+	w := httptest.NewRecorder()
+	ok := f.forwardAuth(w, r, req)
+	if ok {
+		t.Fatal("expected forwardAuth to reject the request")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected WWW-Authenticate header to be forwarded")
+	}
+	if w.Body.String() != "unauthorized" {
+		t.Errorf("expected auth body to be forwarded, got %q", w.Body.String())
+	}
+}
+
+func TestForwardAuth_Redirect(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "https://login.example/sso")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer authServer.Close()
+
+	f := &CUIForwarder{
+		Config: ForwarderConfig{AuthAddress: authServer.URL},
+	}
+
+	r := httptest.NewRequest("GET", "/secret", nil)
+	req, _ := http.NewRequest(r.Method, "http://upstream.example/secret", nil)
+
+	w := httptest.NewRecorder()
+	ok := f.forwardAuth(w, r, req)
+	if ok {
+		t.Fatal("expected forwardAuth to short-circuit on redirect")
+	}
+	if w.Code != http.StatusFound {
+		t.Errorf("expected status 302, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://login.example/sso" {
+		t.Errorf("expected Location header to be forwarded, got %q", loc)
+	}
+}
+
+func TestForwardAuth_TrustForwardHeader(t *testing.T) {
+	var gotXFF string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authServer.Close()
+
+	f := &CUIForwarder{
+		Config: ForwarderConfig{
+			AuthAddress:        authServer.URL,
+			TrustForwardHeader: true,
+		},
+	}
+
+	r := httptest.NewRequest("GET", "/secret", nil)
+	r.Header.Set("X-Forwarded-For", "203.0.113.5")
+	r.RemoteAddr = "192.0.2.1:1234"
+	req, _ := http.NewRequest(r.Method, "http://upstream.example/secret", nil)
+
+	w := httptest.NewRecorder()
+	if !f.forwardAuth(w, r, req) {
+		t.Fatalf("expected forwardAuth to allow the request, got response %d", w.Code)
+	}
+	if gotXFF != "203.0.113.5, 192.0.2.1" {
+		t.Errorf("expected X-Forwarded-For to be trusted and appended to, got %q", gotXFF)
+	}
+}
+
+func TestForwardAuth_SetsClientIPByDefault(t *testing.T) {
+	var gotXFF string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authServer.Close()
+
+	f := &CUIForwarder{
+		Config: ForwarderConfig{AuthAddress: authServer.URL},
+	}
+
+	r := httptest.NewRequest("GET", "/secret", nil)
+	r.RemoteAddr = "203.0.113.9:4242"
+	req, _ := http.NewRequest(r.Method, "http://upstream.example/secret", nil)
+
+	w := httptest.NewRecorder()
+	if !f.forwardAuth(w, r, req) {
+		t.Fatalf("expected forwardAuth to allow the request, got response %d", w.Code)
+	}
+	if gotXFF != "203.0.113.9" {
+		t.Errorf("expected the real peer IP to reach the auth server by default, got %q", gotXFF)
+	}
+}
+
+func TestForwardAuth_Disabled(t *testing.T) {
+	f := &CUIForwarder{}
+	r := httptest.NewRequest("GET", "/secret", nil)
+	req, _ := http.NewRequest(r.Method, "http://upstream.example/secret", nil)
+
+	w := httptest.NewRecorder()
+	if !f.forwardAuth(w, r, req) {
+		t.Fatal("expected forwardAuth to be a no-op when AuthAddress is unset")
+	}
+}
+
 // MockForwarder implements the Forwarder interface for testing
 type MockForwarder struct {
 	// ForwardRequestFunc allows us to customize the behavior of ForwardRequest
@@ -20,7 +186,7 @@ type MockForwarder struct {
 func (m *MockForwarder) ForwardRequest(w http.ResponseWriter, r *http.Request) {
 	m.CallCount++
 	m.LastRequest = r
-	
+
 	if m.ForwardRequestFunc != nil {
 		m.ForwardRequestFunc(w, r)
 	} else {
@@ -142,19 +308,19 @@ func TestCUIForwarderHandler(t *testing.T) {
 func TestCUIForwarderHandler_RequestPassthrough(t *testing.T) {
 	// Test that the handler properly passes through request details
 	mockForwarder := &MockForwarder{}
-	
+
 	// Set up mock to capture and verify request details
 	mockForwarder.ForwardRequestFunc = func(w http.ResponseWriter, r *http.Request) {
 		// Verify headers are passed through
 		if r.Header.Get("X-Custom-Header") != "test-value" {
 			t.Errorf("Expected custom header to be passed through")
 		}
-		
+
 		// Verify query parameters are passed through
 		if r.URL.RawQuery != "param1=value1&param2=value2" {
 			t.Errorf("Expected query parameters to be passed through, got: %s", r.URL.RawQuery)
 		}
-		
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("success"))
 	}
@@ -178,14 +344,14 @@ func TestCUIForwarderHandler_RequestPassthrough(t *testing.T) {
 func TestCUIForwarderHandler_MultipleHeaders(t *testing.T) {
 	// Test that multiple headers with the same name are handled correctly
 	mockForwarder := &MockForwarder{}
-	
+
 	mockForwarder.ForwardRequestFunc = func(w http.ResponseWriter, r *http.Request) {
 		// Check that multiple headers are preserved
 		cookies := r.Header["Cookie"]
 		if len(cookies) != 2 {
 			t.Errorf("Expected 2 Cookie headers, got %d", len(cookies))
 		}
-		
+
 		w.WriteHeader(http.StatusOK)
 	}
 
@@ -202,3 +368,146 @@ func TestCUIForwarderHandler_MultipleHeaders(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 }
+
+func TestSanitizeHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    map[string]bool // header -> expected to still be present
+	}{
+		{
+			name: "removes standard hop-by-hop headers",
+			headers: map[string][]string{
+				"Keep-Alive":          {"timeout=5"},
+				"TE":                  {"trailers"},
+				"Trailers":            {"X-Foo"},
+				"Transfer-Encoding":   {"chunked"},
+				"Upgrade":             {"websocket"},
+				"Proxy-Authorization": {"Basic xyz"},
+				"Content-Type":        {"application/json"},
+			},
+			want: map[string]bool{
+				"Keep-Alive":          false,
+				"TE":                  false,
+				"Trailers":            false,
+				"Transfer-Encoding":   false,
+				"Upgrade":             false,
+				"Proxy-Authorization": false,
+				"Content-Type":        true,
+			},
+		},
+		{
+			name: "removes headers named in Connection value",
+			headers: map[string][]string{
+				"Connection": {"X-Custom"},
+				"X-Custom":   {"secret"},
+				"X-Keep":     {"yes"},
+			},
+			want: map[string]bool{
+				"Connection": false,
+				"X-Custom":   false,
+				"X-Keep":     true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, vv := range tt.headers {
+				for _, v := range vv {
+					h.Add(k, v)
+				}
+			}
+			sanitizeHeaders(h)
+			for k, shouldRemain := range tt.want {
+				_, present := h[http.CanonicalHeaderKey(k)]
+				if present != shouldRemain {
+					t.Errorf("header %q present=%v, want %v", k, present, shouldRemain)
+				}
+			}
+		})
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name              string
+		xForwardedHeaders bool
+		remoteAddr        string
+		tls               bool
+		priorXFF          string
+		priorProto        string
+		priorHost         string
+		wantXFF           string
+		wantProto         string
+	}{
+		{
+			name:       "sets fresh headers by default, ignoring client-supplied values",
+			remoteAddr: "203.0.113.10:54321",
+			priorXFF:   "198.51.100.1",
+			priorProto: "https",
+			wantXFF:    "203.0.113.10",
+			wantProto:  "http",
+		},
+		{
+			name:              "appends to existing X-Forwarded-For when trusted",
+			xForwardedHeaders: true,
+			remoteAddr:        "203.0.113.10:54321",
+			priorXFF:          "198.51.100.1",
+			wantXFF:           "198.51.100.1, 203.0.113.10",
+			wantProto:         "http",
+		},
+		{
+			name:              "trusts existing X-Forwarded-Proto when configured",
+			xForwardedHeaders: true,
+			remoteAddr:        "203.0.113.10:54321",
+			priorProto:        "https",
+			wantXFF:           "203.0.113.10",
+			wantProto:         "https",
+		},
+		{
+			name:       "detects https from TLS when no prior header",
+			remoteAddr: "203.0.113.10:54321",
+			tls:        true,
+			wantXFF:    "203.0.113.10",
+			wantProto:  "https",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &CUIForwarder{Config: ForwarderConfig{XForwardedHeaders: tt.xForwardedHeaders}}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Host = "example.com"
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+
+			h := http.Header{}
+			if tt.priorXFF != "" {
+				h.Set("X-Forwarded-For", tt.priorXFF)
+			}
+			if tt.priorProto != "" {
+				h.Set("X-Forwarded-Proto", tt.priorProto)
+			}
+			if tt.priorHost != "" {
+				h.Set("X-Forwarded-Host", tt.priorHost)
+			}
+
+			f.setForwardedHeaders(h, r)
+
+			if got := h.Get("X-Forwarded-For"); got != tt.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", got, tt.wantXFF)
+			}
+			if got := h.Get("X-Forwarded-Proto"); got != tt.wantProto {
+				t.Errorf("X-Forwarded-Proto = %q, want %q", got, tt.wantProto)
+			}
+			if got := h.Get("X-Real-Ip"); got == "" {
+				t.Error("expected X-Real-Ip to be set")
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connectDialTimeout bounds how long a CONNECT tunnel waits to dial its
+// target before giving up.
+const connectDialTimeout = 10 * time.Second
+
+// isWebSocketUpgrade reports whether r is a WebSocket upgrade handshake, per
+// RFC 6455: an Upgrade: websocket header alongside a Connection header that
+// includes the "upgrade" token.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerContainsToken(r.Header.Get("Connection"), "upgrade")
+}
+
+func headerContainsToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreamingResponse reports whether resp should be flushed incrementally
+// rather than buffered and copied in one shot: Server-Sent Event streams and
+// chunked responses both need bytes delivered to the client as they arrive.
+func isStreamingResponse(resp *http.Response) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	for _, enc := range resp.TransferEncoding {
+		if strings.EqualFold(enc, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// streamResponseBody copies body to w one read at a time, flushing after
+// every write so the client sees data as soon as the upstream sends it,
+// instead of waiting for io.Copy's buffered batches.
+func streamResponseBody(w http.ResponseWriter, body io.Reader) {
+	flusher, canFlush := w.(http.Flusher)
+	buf := make([]byte, 4096)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if readErr != nil {
+			return
+		}
+	}
+}
+
+// serveWebSocket hijacks the client connection and relays it, as raw bytes,
+// to a backend chosen from f's upstream pool, having first replayed the
+// original handshake request so the backend sees the same Upgrade request
+// the client sent.
+func (f *CUIForwarder) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	b, err := f.pickBackend(nil)
+	if err != nil {
+		http.Error(w, "No healthy upstream backend available", http.StatusBadGateway)
+		return
+	}
+	if reporter, ok := w.(upstreamReporter); ok {
+		reporter.reportUpstream(b.url + r.URL.Path)
+	}
+
+	target, err := url.Parse(b.url)
+	if err != nil {
+		http.Error(w, "Invalid backend URL: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	headers := r.Header.Clone()
+	sanitizeHeadersExcept(headers, map[string]bool{"Connection": true, "Upgrade": true})
+	f.setForwardedHeaders(headers, r)
+
+	authed := &http.Request{Header: headers}
+	if !f.forwardAuth(w, r, authed) {
+		return
+	}
+
+	upstreamConn, err := net.Dial("tcp", target.Host)
+	if err != nil {
+		f.recordResult(b, false)
+		http.Error(w, "Failed to dial upstream: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	handshake := &http.Request{
+		Method:     r.Method,
+		URL:        &url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery},
+		Host:       target.Host,
+		Header:     headers,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	if err := handshake.Write(upstreamConn); err != nil {
+		f.recordResult(b, false)
+		http.Error(w, "Failed to write handshake upstream: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade requires a hijackable connection", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "Failed to hijack connection: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	f.recordResult(b, true)
+	atomic.AddInt64(&b.activeConns, 1)
+	defer atomic.AddInt64(&b.activeConns, -1)
+	relay(clientConn, upstreamConn)
+}
+
+// connectHostAllowed reports whether host, as given on a CONNECT request
+// line, may be tunneled to per f.Config.AllowedConnectHosts.
+func (f *CUIForwarder) connectHostAllowed(host string) bool {
+	for _, allowed := range f.Config.AllowedConnectHosts {
+		if allowed == host {
+			return true
+		}
+		if !strings.Contains(allowed, ":") {
+			if h, _, err := net.SplitHostPort(host); err == nil && h == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveConnect implements HTTPS pass-through via CONNECT tunneling: it
+// hijacks the client connection, dials r.Host directly, acknowledges with a
+// 200, and then copies raw bytes in both directions. The destination must be
+// listed in f.Config.AllowedConnectHosts, and, like serveWebSocket, it is
+// gated by ForwardAuth before anything is dialed -- between them, an
+// unauthenticated client can't relay traffic to an arbitrary host and port.
+func (f *CUIForwarder) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if !f.connectHostAllowed(r.Host) {
+		http.Error(w, "CONNECT to "+r.Host+" is not allowed", http.StatusForbidden)
+		return
+	}
+
+	headers := r.Header.Clone()
+	sanitizeHeaders(headers)
+	authed := &http.Request{Header: headers}
+	if !f.forwardAuth(w, r, authed) {
+		return
+	}
+
+	destConn, err := net.DialTimeout("tcp", r.Host, connectDialTimeout)
+	if err != nil {
+		http.Error(w, "Failed to connect to "+r.Host+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		destConn.Close()
+		http.Error(w, "CONNECT requires a hijackable connection", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hj.Hijack()
+	if err != nil {
+		destConn.Close()
+		http.Error(w, "Failed to hijack connection: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		destConn.Close()
+		return
+	}
+
+	relay(clientConn, destConn)
+}
+
+// relay bidirectionally copies bytes between a and b until either side
+// closes, then closes both.
+func relay(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketProxy_HandshakeAndEcho(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		io.Copy(conn, reader) // echo whatever the client sends after the handshake
+	}()
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend("http://" + ln.Addr().String())},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{})
+	proxy := httptest.NewServer(CUIForwarderHandler(f))
+	defer proxy.Close()
+
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := "GET /ws HTTP/1.1\r\n" +
+		"Host: " + proxyAddr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101 Switching Protocols, got %d", resp.StatusCode)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("expected Upgrade: websocket in handshake response, got %q", resp.Header.Get("Upgrade"))
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write payload: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("read echoed payload: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected echoed payload %q, got %q", "hello", buf)
+	}
+}
+
+func TestConnectTunnel_RelaysBytesToDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // echo whatever the client sends through the tunnel
+	}()
+
+	destAddr := ln.Addr().String()
+	f := NewCUIForwarder(nil, ForwarderConfig{AllowedConnectHosts: []string{destAddr}})
+	proxy := httptest.NewServer(CUIForwarderHandler(f))
+	defer proxy.Close()
+
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("CONNECT " + destAddr + " HTTP/1.1\r\nHost: " + destAddr + "\r\n\r\n")); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 Connection Established, got %d", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write tunnel payload: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("read echoed payload: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected echoed payload %q, got %q", "hello", buf)
+	}
+}
+
+func TestConnectTunnel_RejectedByForwardAuth(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer authServer.Close()
+
+	destDialed := make(chan struct{}, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		destDialed <- struct{}{}
+		conn.Close()
+	}()
+
+	destAddr := ln.Addr().String()
+	f := NewCUIForwarder(nil, ForwarderConfig{AuthAddress: authServer.URL, AllowedConnectHosts: []string{destAddr}})
+	proxy := httptest.NewServer(CUIForwarderHandler(f))
+	defer proxy.Close()
+
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("CONNECT " + destAddr + " HTTP/1.1\r\nHost: " + destAddr + "\r\n\r\n")); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected ForwardAuth's 403 to block the tunnel, got %d", resp.StatusCode)
+	}
+
+	select {
+	case <-destDialed:
+		t.Error("expected the destination to never be dialed when ForwardAuth rejects the CONNECT")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnectTunnel_RejectedWhenHostNotAllowlisted(t *testing.T) {
+	destDialed := make(chan struct{}, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		destDialed <- struct{}{}
+		conn.Close()
+	}()
+
+	destAddr := ln.Addr().String()
+	f := NewCUIForwarder(nil, ForwarderConfig{})
+	proxy := httptest.NewServer(CUIForwarderHandler(f))
+	defer proxy.Close()
+
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("CONNECT " + destAddr + " HTTP/1.1\r\nHost: " + destAddr + "\r\n\r\n")); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected CONNECT to be refused with an empty AllowedConnectHosts, got %d", resp.StatusCode)
+	}
+
+	select {
+	case <-destDialed:
+		t.Error("expected the destination to never be dialed when it isn't allowlisted")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebSocketProxy_SurvivesAccessLogWrapping(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		io.Copy(conn, reader)
+	}()
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend("http://" + ln.Addr().String())},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{})
+	var buf bytes.Buffer
+	proxy := httptest.NewServer(NewAccessLogHandler(f, LogOptions{Writer: &buf, Format: JSONLogFormat}))
+	defer proxy.Close()
+
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := "GET /ws HTTP/1.1\r\n" +
+		"Host: " + proxyAddr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the handshake to succeed through the access-log wrapper, got %d", resp.StatusCode)
+	}
+}
+
+func TestSSEStreaming_DeliversEventsIncrementally(t *testing.T) {
+	const delay = 150 * time.Millisecond
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+
+		fmt.Fprintf(w, "data: first\n\n")
+		flusher.Flush()
+		time.Sleep(delay)
+		fmt.Fprintf(w, "data: second\n\n")
+		flusher.Flush()
+	}))
+	defer upstream.Close()
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(upstream.URL)},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{})
+	proxy := httptest.NewServer(CUIForwarderHandler(f))
+	defer proxy.Close()
+
+	start := time.Now()
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("GET proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read first event: %v", err)
+	}
+	firstAt := time.Since(start)
+	if line != "data: first\n" {
+		t.Errorf("expected first SSE event, got %q", line)
+	}
+	if firstAt >= delay {
+		t.Errorf("expected the first event to be flushed immediately, but it arrived after %v (upstream's delay is %v) -- response looks buffered", firstAt, delay)
+	}
+}
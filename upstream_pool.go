@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancePolicy selects how an UpstreamPool picks a healthy backend for
+// each request.
+type LoadBalancePolicy int
+
+const (
+	// RoundRobin cycles through healthy backends in order.
+	RoundRobin LoadBalancePolicy = iota
+	// Random picks a healthy backend uniformly at random.
+	Random
+	// LeastConnections picks the healthy backend with the fewest
+	// in-flight requests.
+	LeastConnections
+)
+
+// HealthCheckConfig configures an UpstreamPool's active health checking.
+// Active checks are disabled when Path is empty.
+type HealthCheckConfig struct {
+	// Path is the path probed on each backend, e.g. "/health".
+	Path string
+	// Interval is how often each backend is probed.
+	Interval time.Duration
+	// Timeout bounds each health check request. Defaults to 2s if unset.
+	Timeout time.Duration
+	// SuccessThreshold is the number of consecutive successful probes
+	// required before an unhealthy backend is marked healthy again.
+	// Defaults to 1.
+	SuccessThreshold int
+}
+
+// backend is one member of an UpstreamPool.
+type backend struct {
+	url    string
+	client *http.Client
+
+	mu            sync.Mutex
+	healthy       bool
+	consecutiveOK int
+
+	activeConns int64
+}
+
+var errNoHealthyBackend = errors.New("upstream pool: no healthy backend available")
+
+// UpstreamPool load-balances requests across a set of backend URLs. It
+// actively probes backends when a HealthCheckConfig.Path is configured, and
+// also supports passive ejection via markFailure/markSuccess when a caller
+// observes a request to a backend fail or succeed.
+type UpstreamPool struct {
+	policy LoadBalancePolicy
+	health HealthCheckConfig
+
+	backends []*backend
+	next     uint64
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewUpstreamPool creates a pool over backendURLs load-balanced with policy.
+// If health.Path is set and health.Interval is positive, a background
+// goroutine actively probes every backend every health.Interval until Close
+// is called.
+func NewUpstreamPool(backendURLs []string, policy LoadBalancePolicy, health HealthCheckConfig) *UpstreamPool {
+	timeout := health.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	backends := make([]*backend, len(backendURLs))
+	for i, u := range backendURLs {
+		backends[i] = &backend{url: u, client: &http.Client{Timeout: timeout}, healthy: true}
+	}
+
+	p := &UpstreamPool{
+		policy:   policy,
+		health:   health,
+		backends: backends,
+		stopCh:   make(chan struct{}),
+	}
+	if health.Path != "" && health.Interval > 0 {
+		go p.runHealthChecks()
+	}
+	return p
+}
+
+func (p *UpstreamPool) runHealthChecks() {
+	ticker := time.NewTicker(p.health.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			for _, b := range p.backends {
+				p.probe(b)
+			}
+		}
+	}
+}
+
+func (p *UpstreamPool) probe(b *backend) {
+	resp, err := b.client.Get(b.url + p.health.Path)
+	ok := err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !ok {
+		b.consecutiveOK = 0
+		b.healthy = false
+		return
+	}
+
+	b.consecutiveOK++
+	threshold := p.health.SuccessThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	if b.consecutiveOK >= threshold {
+		b.healthy = true
+	}
+}
+
+// markFailure passively ejects b, as if an active health check had just
+// failed against it.
+func (p *UpstreamPool) markFailure(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutiveOK = 0
+	b.healthy = false
+}
+
+// markSuccess marks b healthy again after a successful request.
+func (p *UpstreamPool) markSuccess(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthy = true
+}
+
+// Next returns the next backend to use per the pool's load-balancing
+// policy, skipping any backend present in exclude. It returns
+// errNoHealthyBackend if every backend is unhealthy or excluded.
+func (p *UpstreamPool) Next(exclude map[*backend]bool) (*backend, error) {
+	healthy := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		b.mu.Lock()
+		h := b.healthy
+		b.mu.Unlock()
+		if h && !exclude[b] {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, errNoHealthyBackend
+	}
+
+	switch p.policy {
+	case Random:
+		return healthy[rand.Intn(len(healthy))], nil
+	case LeastConnections:
+		best := healthy[0]
+		bestConns := atomic.LoadInt64(&best.activeConns)
+		for _, b := range healthy[1:] {
+			if c := atomic.LoadInt64(&b.activeConns); c < bestConns {
+				best, bestConns = b, c
+			}
+		}
+		return best, nil
+	default: // RoundRobin
+		i := atomic.AddUint64(&p.next, 1) - 1
+		return healthy[int(i)%len(healthy)], nil
+	}
+}
+
+// Close stops the pool's active health-check goroutine, if one is running.
+func (p *UpstreamPool) Close() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBackend(url string) *backend {
+	return &backend{url: url, client: &http.Client{}, healthy: true}
+}
+
+func TestUpstreamPool_RoundRobin(t *testing.T) {
+	p := &UpstreamPool{
+		policy: RoundRobin,
+		backends: []*backend{
+			newTestBackend("http://a"),
+			newTestBackend("http://b"),
+		},
+		stopCh: make(chan struct{}),
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		b, err := p.Next(nil)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		seen[b.url]++
+	}
+	if seen["http://a"] != 2 || seen["http://b"] != 2 {
+		t.Errorf("expected round-robin to alternate evenly, got %v", seen)
+	}
+}
+
+func TestUpstreamPool_LeastConnections(t *testing.T) {
+	b1 := newTestBackend("http://a")
+	b2 := newTestBackend("http://b")
+	b1.activeConns = 3
+	p := &UpstreamPool{
+		policy:   LeastConnections,
+		backends: []*backend{b1, b2},
+		stopCh:   make(chan struct{}),
+	}
+
+	b, err := p.Next(nil)
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if b != b2 {
+		t.Errorf("expected the backend with fewer active connections, got %q", b.url)
+	}
+}
+
+func TestCUIForwarder_LeastConnectionsTracksInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	var busyCalls int32
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&busyCalls, 1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer busy.Close()
+
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer idle.Close()
+
+	busyBackend := newTestBackend(busy.URL)
+	idleBackend := newTestBackend(idle.URL)
+	pool := &UpstreamPool{
+		policy:   LeastConnections,
+		backends: []*backend{busyBackend, idleBackend},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{})
+
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		f.ForwardRequest(w, req)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&busyCalls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the in-flight request to reach the busy backend")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b, err := pool.Next(nil)
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if b != idleBackend {
+		t.Errorf("expected LeastConnections to avoid the backend with an in-flight request, got %q", b.url)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestCUIForwarder_StreamsBodyWithoutBufferingWhenNoRetries(t *testing.T) {
+	received := make(chan []byte, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			t.Errorf("reading first chunk: %v", err)
+		}
+		received <- buf
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(upstream.URL)},
+		stopCh:   make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{})
+
+	pr, pw := io.Pipe()
+	req := httptest.NewRequest("POST", "/upload", pr)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		f.ForwardRequest(w, req)
+		close(done)
+	}()
+
+	if _, err := pw.Write([]byte("hello")); err != nil {
+		t.Fatalf("write first chunk: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if string(got) != "hello" {
+			t.Errorf("expected upstream to see %q as soon as it was written, got %q", "hello", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for upstream to receive the first chunk of an unclosed body -- looks fully buffered before forwarding")
+	}
+
+	pw.Close()
+	<-done
+}
+
+func TestCUIForwarder_RetryReplaysBufferedBody(t *testing.T) {
+	var failingCalls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	var gotBody string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	pool := &UpstreamPool{
+		policy: RoundRobin,
+		backends: []*backend{
+			newTestBackend(failing.URL),
+			newTestBackend(healthy.URL),
+		},
+		stopCh: make(chan struct{}),
+	}
+	f := NewCUIForwarder(pool, ForwarderConfig{MaxRetries: 2})
+
+	req := httptest.NewRequest("PUT", "/", strings.NewReader("payload"))
+	w := httptest.NewRecorder()
+	f.ForwardRequest(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected retry to succeed with status 200, got %d", w.Code)
+	}
+	if gotBody != "payload" {
+		t.Errorf("expected the buffered body to be replayed against the next backend, got %q", gotBody)
+	}
+}
+
+func TestUpstreamPool_ExcludesUnhealthyAndExcluded(t *testing.T) {
+	b1 := newTestBackend("http://a")
+	b2 := newTestBackend("http://b")
+	b2.healthy = false
+	p := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{b1, b2},
+		stopCh:   make(chan struct{}),
+	}
+
+	b, err := p.Next(nil)
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if b != b1 {
+		t.Errorf("expected the only healthy backend, got %q", b.url)
+	}
+
+	_, err = p.Next(map[*backend]bool{b1: true})
+	if err != errNoHealthyBackend {
+		t.Errorf("expected errNoHealthyBackend, got %v", err)
+	}
+}
+
+func TestUpstreamPool_MarkFailureAndSuccess(t *testing.T) {
+	b1 := newTestBackend("http://a")
+	p := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{b1},
+		stopCh:   make(chan struct{}),
+	}
+
+	p.markFailure(b1)
+	if _, err := p.Next(nil); err != errNoHealthyBackend {
+		t.Fatalf("expected backend to be ejected, got err=%v", err)
+	}
+
+	p.markSuccess(b1)
+	if _, err := p.Next(nil); err != nil {
+		t.Fatalf("expected backend to be healthy again, got err=%v", err)
+	}
+}
+
+func TestUpstreamPool_ActiveHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(false)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthy.Load() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	pool := NewUpstreamPool([]string{srv.URL}, RoundRobin, HealthCheckConfig{
+		Path:             "/health",
+		Interval:         10 * time.Millisecond,
+		SuccessThreshold: 2,
+	})
+	defer pool.Close()
+
+	// Starts out marked healthy until the first probe runs.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := pool.Next(nil); err != errNoHealthyBackend {
+		t.Fatalf("expected backend to be ejected by failing health checks, got err=%v", err)
+	}
+
+	healthy.Store(true)
+	// SuccessThreshold is 2, so it takes at least two passing intervals to recover.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := pool.Next(nil); err != nil {
+		t.Fatalf("expected backend to recover after consecutive successful probes, got err=%v", err)
+	}
+}
+
+func TestCUIForwarder_RetriesAgainstNextHealthyBackend(t *testing.T) {
+	var failingCalls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	pool := &UpstreamPool{
+		policy: RoundRobin,
+		backends: []*backend{
+			newTestBackend(failing.URL),
+			newTestBackend(healthy.URL),
+		},
+		stopCh: make(chan struct{}),
+	}
+
+	f := NewCUIForwarder(pool, ForwarderConfig{MaxRetries: 2})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	f.ForwardRequest(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected retry to succeed with status 200, got %d body=%q", w.Code, w.Body.String())
+	}
+	if w.Body.String() != "ok" {
+		t.Errorf("expected body from healthy backend, got %q", w.Body.String())
+	}
+}
+
+func TestCUIForwarder_DoesNotRetryNonIdempotentMethods(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	pool := &UpstreamPool{
+		policy:   RoundRobin,
+		backends: []*backend{newTestBackend(srv.URL)},
+		stopCh:   make(chan struct{}),
+	}
+
+	f := NewCUIForwarder(pool, ForwarderConfig{MaxRetries: 3})
+
+	req := httptest.NewRequest("POST", "/", nil)
+	w := httptest.NewRecorder()
+	f.ForwardRequest(w, req)
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected exactly 1 call for a non-idempotent method, got %d", got)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the upstream's own status to be returned, got %d", w.Code)
+	}
+}